@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lightninglabs/loop"
@@ -14,11 +17,14 @@ import (
 	"github.com/lightninglabs/protobuf-hex-display/json"
 	"github.com/lightninglabs/protobuf-hex-display/jsonpb"
 	"github.com/lightninglabs/protobuf-hex-display/proto"
+	"github.com/lightningnetwork/lnd/macaroons"
 
 	"github.com/btcsuite/btcutil"
 
 	"github.com/urfave/cli"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	macaroon "gopkg.in/macaroon.v2"
 )
 
 var (
@@ -34,6 +40,30 @@ var (
 	// maxMsgRecvSize is the largest message our client will receive. We
 	// set this to 200MiB atm.
 	maxMsgRecvSize = grpc.MaxCallRecvMsgSize(1 * 1024 * 1024 * 200)
+
+	// defaultLoopDirname is the default directory name that is used for
+	// loopd's data directory, under the user's application data
+	// directory.
+	defaultLoopDirname = "loop"
+
+	// defaultTLSCertFilename is the default file name for loopd's
+	// self-signed TLS certificate.
+	defaultTLSCertFilename = "tls.cert"
+
+	// defaultMacaroonFilename is the default file name for the loop.macaroon
+	// that grants access to loopd's RPC.
+	defaultMacaroonFilename = "loop.macaroon"
+
+	// defaultNetwork is the network the CLI assumes it's talking to
+	// loopd on, unless overridden with --network.
+	defaultNetwork = "mainnet"
+
+	// defaultLoopDir is the default location of the loop data directory.
+	// loopd's TLS certificate defaults to a single file directly inside
+	// it, while the macaroon defaults to a network-specific subdirectory.
+	defaultLoopDir = btcutil.AppDataDir(defaultLoopDirname, false)
+
+	defaultTLSCertPath = filepath.Join(defaultLoopDir, defaultTLSCertFilename)
 )
 
 func printJSON(resp interface{}) {
@@ -84,6 +114,57 @@ func main() {
 			Value: "localhost:11010",
 			Usage: "loopd daemon address host:port",
 		},
+		cli.StringFlag{
+			Name:  "network, n",
+			Value: defaultNetwork,
+			Usage: "the network loopd is running on e.g. mainnet, " +
+				"testnet, etc.",
+		},
+		cli.StringFlag{
+			Name:  "tlscertpath",
+			Value: defaultTLSCertPath,
+			Usage: "path to loopd's TLS certificate, used " +
+				"if present; loop falls back to a " +
+				"plaintext connection for an older " +
+				"loopd that doesn't serve TLS",
+		},
+		cli.StringFlag{
+			Name: "macaroonpath",
+			Usage: "path to macaroon file, only needed if loopd " +
+				"and loop are not on the same machine",
+		},
+		cli.BoolFlag{
+			Name: "no-macaroons",
+			Usage: "disable macaroon authentication; has no " +
+				"effect if no macaroon is found anyway",
+		},
+		cli.Int64Flag{
+			Name:  "macaroontimeout",
+			Value: 60,
+			Usage: "anti-replay macaroon validity time in seconds",
+		},
+		cli.StringFlag{
+			Name:  "macaroonip",
+			Usage: "if set, lock macaroon to specific IP address",
+		},
+		cli.BoolFlag{
+			Name: "force, f",
+			Usage: "skip fee limit confirmation, for use in " +
+				"unattended settings such as cron or systemd",
+		},
+		cli.BoolFlag{
+			Name: "json",
+			Usage: "suppress all human-readable prompts and " +
+				"output, emitting structured JSON on stdout " +
+				"instead; implies --force",
+		},
+		cli.Int64Flag{
+			Name: "max_swap_fee_total",
+			Usage: "abort with a non-zero exit code in --force " +
+				"or --json mode if the calculated worst-case " +
+				"swap fees exceed this many sat; 0 disables " +
+				"the check",
+		},
 	}
 	app.Commands = []cli.Command{
 		loopOutCommand, loopInCommand, termsCommand,
@@ -98,8 +179,7 @@ func main() {
 }
 
 func getClient(ctx *cli.Context) (looprpc.SwapClientClient, func(), error) {
-	rpcServer := ctx.GlobalString("rpcserver")
-	conn, err := getClientConn(rpcServer)
+	conn, err := getClientConn(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -141,29 +221,85 @@ func getLimits(amt btcutil.Amount, quote *looprpc.QuoteResponse) *limits {
 	}
 }
 
-func displayLimits(swapType swap.Type, amt, minerFees btcutil.Amount, l *limits,
-	externalHtlc bool, warning string) error {
+// limitsDecision bundles a swap's calculated fee limits together with the
+// context needed to present them, so that the caller can choose to prompt
+// for confirmation, print a summary, or serialize the decision for a
+// scripted caller instead of always prompting interactively.
+type limitsDecision struct {
+	SwapType    string         `json:"swap_type"`
+	Amt         btcutil.Amount `json:"amt"`
+	MinerFees   btcutil.Amount `json:"miner_fees"`
+	TotalMaxSat btcutil.Amount `json:"total_max_sat"`
+	Warning     string         `json:"warning,omitempty"`
+
+	// MaxAllowedSat and Exceeded are only populated when the caller
+	// passed --max_swap_fee_total, letting an unattended caller know
+	// why the swap was aborted.
+	MaxAllowedSat *btcutil.Amount `json:"max_allowed_sat,omitempty"`
+	Exceeded      bool            `json:"exceeded"`
+
+	swapType     swap.Type
+	limits       *limits
+	externalHtlc bool
+}
 
-	totalSuccessMax := l.maxMinerFee + l.maxSwapFee
+// externalHtlcWarning is appended to a Loop In decision's warning when the
+// swap uses an externally published HTLC, whose on-chain fee isn't reflected
+// in TotalMaxSat.
+const externalHtlcWarning = "On-chain fee for external loop in is not " +
+	"included. Sufficient fees will need to be paid when constructing " +
+	"the transaction in the external wallet."
+
+// newLimitsDecision calculates the total worst-case fees for a swap and
+// returns them as a limitsDecision. If maxAllowed is positive, the decision
+// is marked Exceeded when the total worst-case fees surpass it.
+func newLimitsDecision(swapType swap.Type, amt, minerFees btcutil.Amount,
+	l *limits, externalHtlc bool, warning string,
+	maxAllowed btcutil.Amount) *limitsDecision {
+
+	total := l.maxMinerFee + l.maxSwapFee
 	if l.maxSwapRoutingFee != nil {
-		totalSuccessMax += *l.maxSwapRoutingFee
+		total += *l.maxSwapRoutingFee
 	}
 	if l.maxPrepayRoutingFee != nil {
-		totalSuccessMax += *l.maxPrepayRoutingFee
+		total += *l.maxPrepayRoutingFee
 	}
 
 	if swapType == swap.TypeIn && externalHtlc {
-		fmt.Printf("On-chain fee for external loop in is not " +
-			"included.\nSufficient fees will need to be paid " +
-			"when constructing the transaction in the external " +
-			"wallet.\n\n")
+		if warning != "" {
+			warning += "\n"
+		}
+		warning += externalHtlcWarning
 	}
 
-	fmt.Printf("Max swap fees for %d sat Loop %v: %d sat\n", amt, swapType,
-		totalSuccessMax)
+	d := &limitsDecision{
+		SwapType:     swapType.String(),
+		Amt:          amt,
+		MinerFees:    minerFees,
+		TotalMaxSat:  total,
+		Warning:      warning,
+		swapType:     swapType,
+		limits:       l,
+		externalHtlc: externalHtlc,
+	}
+
+	if maxAllowed > 0 {
+		d.MaxAllowedSat = &maxAllowed
+		d.Exceeded = total > maxAllowed
+	}
+
+	return d
+}
 
-	if warning != "" {
-		fmt.Println(warning)
+// confirm prints the decision's summary and prompts the user to confirm it
+// interactively, optionally expanding the fee breakdown. It returns an error
+// if the swap is declined.
+func (d *limitsDecision) confirm() error {
+	fmt.Printf("Max swap fees for %d sat Loop %v: %d sat\n", d.Amt,
+		d.SwapType, d.TotalMaxSat)
+
+	if d.Warning != "" {
+		fmt.Println(d.Warning)
 	}
 
 	fmt.Printf("CONTINUE SWAP? (y/n), expand fee detail (x): ")
@@ -177,17 +313,18 @@ func displayLimits(swapType swap.Type, amt, minerFees btcutil.Amount, l *limits,
 	case "x":
 		fmt.Println()
 		f := "%-36s %d sat\n"
+		l := d.limits
 
-		switch swapType {
+		switch d.swapType {
 		case swap.TypeOut:
 			fmt.Printf(f, "Estimated on-chain sweep fee:",
-				minerFees)
+				d.MinerFees)
 			fmt.Printf(f, "Max on-chain sweep fee:", l.maxMinerFee)
 
 		case swap.TypeIn:
-			if !externalHtlc {
+			if !d.externalHtlc {
 				fmt.Printf(f, "Estimated on-chain HTLC fee:",
-					minerFees)
+					d.MinerFees)
 			}
 		}
 
@@ -216,6 +353,48 @@ func displayLimits(swapType swap.Type, amt, minerFees btcutil.Amount, l *limits,
 	return errors.New("swap canceled")
 }
 
+// displayLimits presents the calculated fee limits for a swap to the caller,
+// either by prompting for interactive confirmation, printing a summary and
+// proceeding unattended when --force is set, or emitting the decision as
+// JSON on stdout when --json is set so a scripted caller can evaluate it.
+func displayLimits(ctx *cli.Context, swapType swap.Type, amt, minerFees btcutil.Amount,
+	l *limits, externalHtlc bool, warning string) error {
+
+	maxAllowed := btcutil.Amount(ctx.GlobalInt64("max_swap_fee_total"))
+	decision := newLimitsDecision(
+		swapType, amt, minerFees, l, externalHtlc, warning, maxAllowed,
+	)
+
+	switch {
+	case ctx.GlobalBool("json"):
+		printJSON(decision)
+		if decision.Exceeded {
+			return fmt.Errorf("total swap fees of %d sat exceed "+
+				"the %d sat limit set with "+
+				"--max_swap_fee_total", decision.TotalMaxSat,
+				maxAllowed)
+		}
+		return nil
+
+	case ctx.GlobalBool("force"):
+		fmt.Printf("Max swap fees for %d sat Loop %v: %d sat\n",
+			decision.Amt, decision.SwapType, decision.TotalMaxSat)
+		if decision.Warning != "" {
+			fmt.Println(decision.Warning)
+		}
+		if decision.Exceeded {
+			return fmt.Errorf("total swap fees of %d sat exceed "+
+				"the %d sat limit set with "+
+				"--max_swap_fee_total", decision.TotalMaxSat,
+				maxAllowed)
+		}
+		return nil
+
+	default:
+		return decision.confirm()
+	}
+}
+
 func parseAmt(text string) (btcutil.Amount, error) {
 	amtInt64, err := strconv.ParseInt(text, 10, 64)
 	if err != nil {
@@ -224,7 +403,15 @@ func parseAmt(text string) (btcutil.Amount, error) {
 	return btcutil.Amount(amtInt64), nil
 }
 
-func logSwap(swap *looprpc.SwapStatus) {
+// logSwap prints a single line summary of a swap's status, or, when --json
+// is set, encodes the full status message as JSON so it can be consumed by
+// a scripted caller instead.
+func logSwap(ctx *cli.Context, swap *looprpc.SwapStatus) {
+	if ctx.GlobalBool("json") {
+		printRespJSON(swap)
+		return
+	}
+
 	if swap.Type == looprpc.SwapType_LOOP_OUT {
 		fmt.Printf("%v %v %v %v - %v",
 			time.Unix(0, swap.LastUpdateTime).Format(time.RFC3339),
@@ -256,12 +443,66 @@ func logSwap(swap *looprpc.SwapStatus) {
 	fmt.Println()
 }
 
-func getClientConn(address string) (*grpc.ClientConn, error) {
+// getClientConn dials loopd's gRPC interface. If the daemon's TLS
+// certificate and/or macaroon are present at the resolved paths, the
+// connection is authenticated with them. Only when a path is unset or
+// genuinely absent does this fall back to the previous plaintext,
+// unauthenticated dial, so this CLI keeps working unmodified against an
+// older loopd that doesn't serve TLS or macaroons yet; any other error (e.g.
+// a permissions problem reading an existing file) is treated as fatal
+// instead of silently downgrading the connection.
+func getClientConn(ctx *cli.Context) (*grpc.ClientConn, error) {
 	opts := []grpc.DialOption{
-		grpc.WithInsecure(),
 		grpc.WithDefaultCallOptions(maxMsgRecvSize),
 	}
 
+	tlsCertPath := ctx.GlobalString("tlscertpath")
+	tlsCertExists, err := pathExists(tlsCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to stat TLS cert path %v: %v",
+			tlsCertPath, err)
+	}
+
+	if tlsCertExists {
+		creds, err := credentials.NewClientTLSFromFile(tlsCertPath, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS cert: %v", err)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		fmt.Fprintln(os.Stderr, "[loop] warning: no TLS cert found "+
+			"at "+tlsCertPath+", connecting without TLS "+
+			"authentication")
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if !ctx.GlobalBool("no-macaroons") {
+		macPath, err := macaroonPath(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		macExists, err := pathExists(macPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to stat macaroon "+
+				"path %v: %v", macPath, err)
+		}
+
+		if macExists {
+			macCred, err := getMacaroonCredential(ctx, macPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load "+
+					"macaroon: %v", err)
+			}
+			opts = append(opts, grpc.WithPerRPCCredentials(macCred))
+		} else {
+			fmt.Fprintln(os.Stderr, "[loop] warning: no macaroon "+
+				"found at "+macPath+", connecting without "+
+				"macaroon authentication")
+		}
+	}
+
+	address := ctx.GlobalString("rpcserver")
 	conn, err := grpc.Dial(address, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to RPC server: %v", err)
@@ -269,3 +510,77 @@ func getClientConn(address string) (*grpc.ClientConn, error) {
 
 	return conn, nil
 }
+
+// pathExists reports whether a file exists at path. An empty path is
+// reported as not existing. Any error other than the path simply not
+// existing (e.g. a permissions error) is returned to the caller rather than
+// treated as "not found", since silently downgrading security on an
+// unrelated stat failure would be unsafe.
+func pathExists(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+
+	_, err := os.Stat(path)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// getMacaroonCredential loads the macaroon at macPath from disk, applies any
+// requested constraints (timeout and IP lock) to it and wraps it in a
+// credential that can be attached to an outgoing RPC.
+func getMacaroonCredential(ctx *cli.Context, macPath string) (*macaroons.MacaroonCredential, error) {
+	macBytes, err := ioutil.ReadFile(macPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read macaroon path %v: %v",
+			macPath, err)
+	}
+
+	mac := &macaroon.Macaroon{}
+	if err := mac.UnmarshalBinary(macBytes); err != nil {
+		return nil, fmt.Errorf("unable to decode macaroon: %v", err)
+	}
+
+	var constraints []macaroons.Constraint
+	if timeout := ctx.GlobalInt64("macaroontimeout"); timeout > 0 {
+		constraints = append(
+			constraints, macaroons.TimeoutConstraint(timeout),
+		)
+	}
+	if ip := ctx.GlobalString("macaroonip"); ip != "" {
+		constraints = append(
+			constraints, macaroons.IPLockConstraint(ip),
+		)
+	}
+
+	constrainedMac, err := macaroons.AddConstraints(mac, constraints...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to constrain macaroon: %v", err)
+	}
+
+	return macaroons.NewMacaroonCredential(constrainedMac), nil
+}
+
+// macaroonPath returns the path of the macaroon to use, resolving it to a
+// network-specific default under the loop data directory when the
+// --macaroonpath flag isn't set explicitly.
+func macaroonPath(ctx *cli.Context) (string, error) {
+	if path := ctx.GlobalString("macaroonpath"); path != "" {
+		return path, nil
+	}
+
+	network := strings.ToLower(ctx.GlobalString("network"))
+	switch network {
+	case "mainnet", "testnet", "regtest", "simnet":
+	default:
+		return "", fmt.Errorf("unknown network: %v", network)
+	}
+
+	return filepath.Join(defaultLoopDir, network, defaultMacaroonFilename), nil
+}